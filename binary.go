@@ -0,0 +1,274 @@
+package keg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// dexBinMagic identifies a dex/latest.bin file.
+var dexBinMagic = [4]byte{'K', 'D', 'E', 'X'}
+
+// dexBinVersion is the current dex/latest.bin format version. Readers
+// must fall back to dex/latest.md when a file's version does not
+// match.
+const dexBinVersion uint32 = 1
+
+// dexBinHeaderLen is the fixed size, in bytes, of the dex/latest.bin
+// header: magic[4] + version uint32 + count uint32 + hash-algo tag
+// byte + 3 bytes padding + index offset uint64.
+const dexBinHeaderLen = 4 + 4 + 4 + 1 + 3 + 8
+
+// dexBinRecordLen is the size, in bytes, of a dex/latest.bin record
+// excluding its variable-length title: unix-nano uint64 + node-id
+// uint32 + title-len uint16.
+const dexBinRecordLen = 8 + 4 + 2
+
+// hashAlgoTag maps a NodeHasher's Name to the single-byte tag stored
+// in the dex/latest.bin header, so a reader can tell which algorithm
+// produced dex/hashes.tsv without needing ScanDexWithHasher's caller
+// to say so out of band. 0 means "unknown/unset".
+func hashAlgoTag(name string) byte {
+	switch name {
+	case Blake2bHasher{}.Name():
+		return 1
+	case Blake3Hasher{}.Name():
+		return 2
+	case Sha256Hasher{}.Name():
+		return 3
+	default:
+		return 0
+	}
+}
+
+// binPath returns the path to the dex/latest.bin file for the keg at
+// kegdir.
+func binPath(kegdir string) string {
+	return filepath.Join(kegdir, `dex`, `latest.bin`)
+}
+
+// dexBinIndexEntry is one row of the trailing node-id -> offset table
+// written after the records in dex/latest.bin, kept sorted by ID so
+// lookups can binary search it instead of scanning every record.
+type dexBinIndexEntry struct {
+	ID     uint32
+	Offset uint64 // byte offset of the record, relative to the start of the records section
+}
+
+// WriteDexBinary writes dex/latest.bin for the keg at kegdir: a
+// header (magic, version, entry count, hash-algo tag) followed by
+// fixed-width records sorted by update time descending, followed by a
+// secondary table mapping node ID to record offset sorted by ID, so
+// that LookupNodeBinary can find a single record in O(log N) without
+// reading the rest of the file. algo names the hash algorithm
+// recorded in the header (see hashAlgoTag); pass "" if none applies.
+func WriteDexBinary(kegdir string, dex *Dex, algo string) error {
+	entries := append(Dex{}, *dex...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].U.After(entries[j].U) })
+
+	var records bytes.Buffer
+	index := make([]dexBinIndexEntry, 0, len(entries))
+
+	for _, e := range entries {
+		title := []byte(e.T)
+		if len(title) > math.MaxUint16 {
+			title = title[:math.MaxUint16]
+		}
+
+		index = append(index, dexBinIndexEntry{
+			ID:     uint32(e.N),
+			Offset: uint64(records.Len()),
+		})
+
+		binary.Write(&records, binary.BigEndian, uint64(e.U.UnixNano()))
+		binary.Write(&records, binary.BigEndian, uint32(e.N))
+		binary.Write(&records, binary.BigEndian, uint16(len(title)))
+		records.Write(title)
+	}
+
+	sort.Slice(index, func(i, j int) bool { return index[i].ID < index[j].ID })
+
+	var out bytes.Buffer
+	out.Write(dexBinMagic[:])
+	binary.Write(&out, binary.BigEndian, dexBinVersion)
+	binary.Write(&out, binary.BigEndian, uint32(len(entries)))
+	out.WriteByte(hashAlgoTag(algo))
+	out.Write([]byte{0, 0, 0})
+	binary.Write(&out, binary.BigEndian, uint64(dexBinHeaderLen+records.Len()))
+	out.Write(records.Bytes())
+	for _, i := range index {
+		binary.Write(&out, binary.BigEndian, i.ID)
+		binary.Write(&out, binary.BigEndian, i.Offset)
+	}
+
+	return atomicWriteBytes(binPath(kegdir), out.Bytes())
+}
+
+// dexBinHeader holds the parsed header of a dex/latest.bin file.
+type dexBinHeader struct {
+	Version     uint32
+	Count       uint32
+	HashAlgo    byte
+	IndexOffset uint64
+}
+
+func readDexBinHeader(buf []byte) (*dexBinHeader, error) {
+	if len(buf) < dexBinHeaderLen {
+		return nil, fmt.Errorf("dex/latest.bin: truncated header")
+	}
+	if !bytes.Equal(buf[:4], dexBinMagic[:]) {
+		return nil, fmt.Errorf("dex/latest.bin: bad magic")
+	}
+	h := &dexBinHeader{
+		Version:     binary.BigEndian.Uint32(buf[4:8]),
+		Count:       binary.BigEndian.Uint32(buf[8:12]),
+		HashAlgo:    buf[12],
+		IndexOffset: binary.BigEndian.Uint64(buf[16:24]),
+	}
+	if h.Version != dexBinVersion {
+		return nil, fmt.Errorf(
+			"dex/latest.bin: unsupported version %v (want %v)", h.Version, dexBinVersion,
+		)
+	}
+	return h, nil
+}
+
+// ReadDexBinary reads dex/latest.bin for the keg at kegdir and returns
+// its entries as a Dex, sorted by update time descending (the order
+// they were written in). It returns an error if the file is missing,
+// truncated, or carries a version tag that doesn't match
+// dexBinVersion, so that callers can fall back to dex/latest.md (see
+// ReadDex).
+func ReadDexBinary(kegdir string) (*Dex, error) {
+	buf, err := os.ReadFile(binPath(kegdir))
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := readDexBinHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var dex Dex
+	off := dexBinHeaderLen
+	for i := uint32(0); i < h.Count; i++ {
+		if off+dexBinRecordLen > len(buf) {
+			return nil, fmt.Errorf("dex/latest.bin: truncated record %v", i)
+		}
+		nano := binary.BigEndian.Uint64(buf[off : off+8])
+		id := binary.BigEndian.Uint32(buf[off+8 : off+12])
+		titleLen := int(binary.BigEndian.Uint16(buf[off+12 : off+14]))
+		off += dexBinRecordLen
+		if off+titleLen > len(buf) {
+			return nil, fmt.Errorf("dex/latest.bin: truncated title in record %v", i)
+		}
+		title := string(buf[off : off+titleLen])
+		off += titleLen
+
+		dex = append(dex, DexEntry{
+			U: time.Unix(0, int64(nano)).UTC(),
+			T: title,
+			N: int(id),
+		})
+	}
+
+	return &dex, nil
+}
+
+// LookupNodeBinary looks up a single node by ID directly in
+// dex/latest.bin, binary searching the trailing node-id -> offset
+// table and reading only that one record, without parsing the rest of
+// the file. It returns nil (with no error) if dex/latest.bin doesn't
+// exist, is stale (its version tag doesn't match dexBinVersion), or has
+// no entry for id.
+func LookupNodeBinary(kegdir string, id int) (*DexEntry, error) {
+	buf, err := os.ReadFile(binPath(kegdir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := readDexBinHeader(buf)
+	if err != nil {
+		if len(buf) >= 8 && bytes.Equal(buf[:4], dexBinMagic[:]) &&
+			binary.BigEndian.Uint32(buf[4:8]) != dexBinVersion {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	indexBuf := buf[h.IndexOffset:]
+	const entLen = 4 + 8
+	n := len(indexBuf) / entLen
+	want := uint32(id)
+
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		rec := indexBuf[mid*entLen : mid*entLen+entLen]
+		got := binary.BigEndian.Uint32(rec[:4])
+		if got < want {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo >= n {
+		return nil, nil
+	}
+	rec := indexBuf[lo*entLen : lo*entLen+entLen]
+	got := binary.BigEndian.Uint32(rec[:4])
+	if got != want {
+		return nil, nil
+	}
+	offset := dexBinHeaderLen + int(binary.BigEndian.Uint64(rec[4:entLen]))
+
+	if offset+dexBinRecordLen > len(buf) {
+		return nil, fmt.Errorf("dex/latest.bin: truncated record for node %v", id)
+	}
+	nano := binary.BigEndian.Uint64(buf[offset : offset+8])
+	nodeID := binary.BigEndian.Uint32(buf[offset+8 : offset+12])
+	titleLen := int(binary.BigEndian.Uint16(buf[offset+12 : offset+14]))
+	start := offset + dexBinRecordLen
+	if start+titleLen > len(buf) {
+		return nil, fmt.Errorf("dex/latest.bin: truncated title for node %v", id)
+	}
+
+	return &DexEntry{
+		U: time.Unix(0, int64(nano)).UTC(),
+		T: string(buf[start : start+titleLen]),
+		N: int(nodeID),
+	}, nil
+}
+
+// LookupByID does a binary search through d for the entry with the
+// given node ID and returns it, or nil if not found. It assumes d is
+// already sorted ascending by ID (as Dex.ByID produces; ReadDexBinary
+// returns entries by update time, so sort its result with ByID before
+// calling LookupByID); call LookupNodeBinary instead when
+// you only need one node and want to avoid reading the rest of
+// dex/latest.bin.
+func (d Dex) LookupByID(id int) *DexEntry {
+	n := len(d)
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if d[mid].N < id {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < n && d[lo].N == id {
+		return &d[lo]
+	}
+	return nil
+}
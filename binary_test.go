@@ -0,0 +1,52 @@
+package keg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteReadLookupDexBinary_RoundTrip(t *testing.T) {
+	kegdir := t.TempDir()
+
+	dex := Dex{
+		{U: time.Unix(1700000000, 0).UTC(), T: "First node", N: 1},
+		{U: time.Unix(1700000500, 0).UTC(), T: "Second node", N: 2},
+		{U: time.Unix(1700000250, 0).UTC(), T: "Third node", N: 3},
+	}
+
+	if err := WriteDexBinary(kegdir, &dex, DefaultHasher.Name()); err != nil {
+		t.Fatalf("WriteDexBinary: %v", err)
+	}
+
+	got, err := ReadDexBinary(kegdir)
+	if err != nil {
+		t.Fatalf("ReadDexBinary: %v", err)
+	}
+
+	want := Dex{
+		{U: time.Unix(1700000500, 0).UTC(), T: "Second node", N: 2},
+		{U: time.Unix(1700000250, 0).UTC(), T: "Third node", N: 3},
+		{U: time.Unix(1700000000, 0).UTC(), T: "First node", N: 1},
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Fatalf("ReadDexBinary = %+v, want %+v (update-time descending)", *got, want)
+	}
+
+	for _, e := range dex {
+		entry, err := LookupNodeBinary(kegdir, e.N)
+		if err != nil {
+			t.Fatalf("LookupNodeBinary(%v): %v", e.N, err)
+		}
+		if entry == nil {
+			t.Fatalf("LookupNodeBinary(%v) = nil, want an entry", e.N)
+		}
+		if entry.N != e.N || entry.T != e.T || !entry.U.Equal(e.U) {
+			t.Fatalf("LookupNodeBinary(%v) = %+v, want %+v", e.N, entry, e)
+		}
+	}
+
+	if entry, err := LookupNodeBinary(kegdir, 999); err != nil || entry != nil {
+		t.Fatalf("LookupNodeBinary(999) = %+v, %v, want nil, nil", entry, err)
+	}
+}
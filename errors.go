@@ -0,0 +1,102 @@
+package keg
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Error is a structured error carrying enough context — the
+// operation, the keg path, the node and dex line involved, and the
+// exact source location that produced it — for a caller to report
+// something more useful than "bad line in latest.md: 137" when, say,
+// MakeDex fails partway through a keg of several thousand nodes. Build
+// one with ErrLine rather than constructing it directly.
+type Error struct {
+	Op       string // function that called ErrLine, e.g. "github.com/rwxrob/keg.ParseDex"
+	Path     string // keg or node path involved, if any
+	NodeID   int    // node ID involved, if any (0 if not applicable)
+	Line     int    // dex/latest.md line number involved, if any (0 if not applicable)
+	File     string // source file that called ErrLine
+	FuncLine int    // source line within File that called ErrLine
+	Err      error  // the wrapped error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%v:%v", e.File, e.FuncLine)
+	if e.Op != "" {
+		msg += fmt.Sprintf(" %v", e.Op)
+	}
+	if e.Path != "" {
+		msg += fmt.Sprintf(" %v", e.Path)
+	}
+	if e.NodeID != 0 {
+		msg += fmt.Sprintf(" node %v", e.NodeID)
+	}
+	if e.Line != 0 {
+		msg += fmt.Sprintf(" line %v", e.Line)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is and errors.As to see through Error to the
+// error it wraps.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports target as matching e when target is itself an *Error
+// whose set fields (Op/NodeID) agree with e's, allowing callers to
+// match on "any ParseDex error" or "any error about node 4271" with
+// errors.Is without caring about the wrapped error underneath.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	if t.Op != "" && t.Op != e.Op {
+		return false
+	}
+	if t.NodeID != 0 && t.NodeID != e.NodeID {
+		return false
+	}
+	return true
+}
+
+// ErrOption sets an optional field on an Error built by ErrLine.
+type ErrOption func(*Error)
+
+// WithPath attaches the keg or node path involved in the error.
+func WithPath(path string) ErrOption { return func(e *Error) { e.Path = path } }
+
+// WithNodeID attaches the node ID involved in the error.
+func WithNodeID(id int) ErrOption { return func(e *Error) { e.NodeID = id } }
+
+// WithLine attaches the dex/latest.md line number involved in the
+// error.
+func WithLine(line int) ErrOption { return func(e *Error) { e.Line = line } }
+
+// ErrLine wraps err in an *Error that records the source location
+// (file and line) and calling function of its caller, captured via
+// runtime.Caller(1), plus whatever context opts attach. It returns nil
+// if err is nil, so it is always safe to write "return ErrLine(err)"
+// in place of "return err".
+func ErrLine(err error, opts ...ErrOption) error {
+	if err == nil {
+		return nil
+	}
+
+	e := &Error{Err: err}
+	if pc, file, line, ok := runtime.Caller(1); ok {
+		e.File = file
+		e.FuncLine = line
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			e.Op = fn.Name()
+		}
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
@@ -0,0 +1,338 @@
+package keg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+
+	"github.com/rwxrob/keg/kegml"
+)
+
+// NodeHasher computes a content hash for a single node directory,
+// allowing callers to pick the algorithm used for change detection
+// (see ScanDexWithHashes) without touching the scanning logic itself.
+type NodeHasher interface {
+
+	// HashNode returns the hex-encoded hash of every file under
+	// nodedir (path, mode, and content), or an error if the directory
+	// could not be read.
+	HashNode(nodedir string) (string, error)
+
+	// Name returns the short algorithm name recorded in
+	// dex/hashes.tsv (e.g. "blake2b", "blake3", "sha256").
+	Name() string
+}
+
+// DefaultHasher is the NodeHasher used by ScanDexWithHashes and
+// MakeDex when no other hasher is specified. It may be reassigned to
+// change the algorithm keg-wide.
+var DefaultHasher NodeHasher = Blake2bHasher{}
+
+// Blake2bHasher hashes node contents with BLAKE2b-256.
+type Blake2bHasher struct{}
+
+func (Blake2bHasher) Name() string { return `blake2b` }
+
+func (h Blake2bHasher) HashNode(nodedir string) (string, error) {
+	sum, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	return hashNodeWith(sum, nodedir)
+}
+
+// Blake3Hasher hashes node contents with BLAKE3.
+type Blake3Hasher struct{}
+
+func (Blake3Hasher) Name() string { return `blake3` }
+
+func (Blake3Hasher) HashNode(nodedir string) (string, error) {
+	return hashNodeWith(blake3.New(32, nil), nodedir)
+}
+
+// Sha256Hasher hashes node contents with SHA-256.
+type Sha256Hasher struct{}
+
+func (Sha256Hasher) Name() string { return `sha256` }
+
+func (Sha256Hasher) HashNode(nodedir string) (string, error) {
+	return hashNodeWith(sha256.New(), nodedir)
+}
+
+// hashNodeWith walks nodedir in sorted (lexical) order and feeds the
+// relative path and file mode of every entry, plus the content of
+// every regular file, into h, returning the resulting hex digest.
+// Directory entries themselves do not contribute beyond ordering.
+// Symlinks contribute their link target string rather than the
+// content of whatever they point at, so a dangling symlink or one
+// pointing at a directory doesn't fail the scan; other non-regular
+// entries (devices, sockets, etc.) contribute only their path and
+// mode above.
+func hashNodeWith(h hash.Hash, nodedir string) (string, error) {
+	var paths []string
+	err := filepath.WalkDir(nodedir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		rel, err := filepath.Rel(nodedir, p)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%v\t%o\n", filepath.ToSlash(rel), info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintln(h, target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashRecord is one row of the dex/hashes.tsv sidecar: the last known
+// content hash, directory size, and update time (Mtime, the time the
+// scan last saw the content change) for a single node, used to tell a real
+// content change from a mere mtime bump (git clone, rsync, tar
+// extraction, editor save-in-place, etc.).
+type HashRecord struct {
+	Node  int
+	Mtime time.Time
+	Size  int64
+	Hash  string
+}
+
+// hashesPath returns the path to the dex/hashes.tsv sidecar within
+// kegdir.
+func hashesPath(kegdir string) string {
+	return filepath.Join(kegdir, `dex`, `hashes.tsv`)
+}
+
+// ReadHashes reads the dex/hashes.tsv sidecar for kegdir, returning an
+// empty (non-nil) map if the sidecar does not exist yet.
+func ReadHashes(kegdir string) (map[int]HashRecord, error) {
+	records := map[int]HashRecord{}
+
+	buf, err := os.ReadFile(hashesPath(kegdir))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for n, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 4 {
+			return nil, fmt.Errorf("bad line in hashes.tsv: %v", n+1)
+		}
+		id, err := strconv.Atoi(f[0])
+		if err != nil {
+			return nil, err
+		}
+		mtime, err := time.Parse(time.RFC3339, f[1])
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		records[id] = HashRecord{Node: id, Mtime: mtime, Size: size, Hash: f[3]}
+	}
+
+	return records, nil
+}
+
+// WriteHashes overwrites the dex/hashes.tsv sidecar for kegdir with
+// records, sorted numerically by node ID.
+func WriteHashes(kegdir string, records map[int]HashRecord) error {
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var buf strings.Builder
+	for _, id := range ids {
+		r := records[id]
+		fmt.Fprintf(&buf, "%v\t%v\t%v\t%v\n",
+			r.Node, r.Mtime.UTC().Format(time.RFC3339Nano), r.Size, r.Hash)
+	}
+
+	return atomicWriteFile(hashesPath(kegdir), buf.String())
+}
+
+// ScanDexWithHashes is like ScanDex but orders entries (and decides
+// what counts as "updated") by content hash rather than by raw
+// filesystem mtime, using DefaultHasher. See ScanDexWithHasher for a
+// version that takes an explicit NodeHasher.
+func ScanDexWithHashes(kegdir string) (*Dex, error) {
+	return ScanDexWithHasher(kegdir, DefaultHasher)
+}
+
+// ScanDexWithHasher is like ScanDex but orders entries (and decides
+// what counts as "updated") by content hash rather than by raw
+// filesystem mtime. For each node it recomputes the hash with hasher
+// and compares it against the previously recorded one in
+// dex/hashes.tsv: if the hash is unchanged, the node keeps its
+// previously recorded update time even though the filesystem mtime may
+// have moved (as happens after a git clone, an rsync without -t, or a
+// tar extraction); if the hash differs (or there is no prior record),
+// the node is considered updated now. The refreshed hash records are
+// written back to dex/hashes.tsv before returning.
+//
+// dex/hashes.tsv is read and rewritten under the same dex/.lock
+// exclusive lock as MakeDex (see withExclusiveLock), so a concurrent
+// MakeDexContext or another ScanDexWithHasher call can't interleave
+// its own read-modify-write of the sidecar and lose hash records.
+func ScanDexWithHasher(kegdir string, hasher NodeHasher) (*Dex, error) {
+	var dex *Dex
+	err := withExclusiveLock(context.Background(), kegdir, func() error {
+		var err error
+		dex, err = scanDexWithHasherLocked(kegdir, hasher)
+		return err
+	})
+	return dex, err
+}
+
+func scanDexWithHasherLocked(kegdir string, hasher NodeHasher) (*Dex, error) {
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+
+	prior, err := ReadHashes(kegdir)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, _, _ := NodePaths(kegdir)
+	next := make(map[int]HashRecord, len(dirs))
+	var dex Dex
+
+	for _, d := range dirs {
+		id, err := strconv.Atoi(d.Info.Name())
+		if err != nil {
+			continue
+		}
+
+		sum, err := hasher.HashNode(d.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := os.Stat(d.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		when := time.Now().UTC()
+		if old, ok := prior[id]; ok && old.Hash == sum {
+			when = old.Mtime
+		}
+		next[id] = HashRecord{Node: id, Mtime: when, Size: info.Size(), Hash: sum}
+
+		title, _ := kegml.ReadTitle(d.Path)
+		dex = append(dex, DexEntry{U: when, T: title, N: id})
+	}
+
+	if err := WriteHashes(kegdir, next); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(dex, func(i, j int) bool { return dex[i].U.After(dex[j].U) })
+
+	return &dex, nil
+}
+
+// FsckResult describes one node whose recorded content hash no longer
+// matches its contents, as reported by Fsck.
+type FsckResult struct {
+	Node     int
+	Recorded string
+	Actual   string
+}
+
+// Fsck recomputes the hash of every node in the keg at kegdir with
+// hasher and compares it against dex/hashes.tsv, reporting every node
+// whose recorded hash doesn't match its current contents. Nodes with
+// no recorded hash yet are not reported as mismatches. It does not
+// modify dex/hashes.tsv; run MakeDex or ScanDexWithHashes to refresh
+// it.
+func Fsck(kegdir string, hasher NodeHasher) ([]FsckResult, error) {
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+
+	prior, err := ReadHashes(kegdir)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, _, _ := NodePaths(kegdir)
+	var bad []FsckResult
+
+	for _, d := range dirs {
+		id, err := strconv.Atoi(d.Info.Name())
+		if err != nil {
+			continue
+		}
+		recorded, ok := prior[id]
+		if !ok {
+			continue
+		}
+		sum, err := hasher.HashNode(d.Path)
+		if err != nil {
+			return nil, err
+		}
+		if sum != recorded.Hash {
+			bad = append(bad, FsckResult{Node: id, Recorded: recorded.Hash, Actual: sum})
+		}
+	}
+
+	return bad, nil
+}
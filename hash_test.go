@@ -0,0 +1,96 @@
+package keg
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeNode(t *testing.T, kegdir string, id int, content string) string {
+	t.Helper()
+	nodedir := filepath.Join(kegdir, strconv.Itoa(id))
+	if err := os.MkdirAll(nodedir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	readme := filepath.Join(nodedir, `README.md`)
+	if err := os.WriteFile(readme, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return readme
+}
+
+func TestScanDexWithHashes_StableAcrossMtimeTouch(t *testing.T) {
+	kegdir := t.TempDir()
+	readme := writeNode(t, kegdir, 1, "# Node 1\n\nOriginal content.\n")
+
+	dex1, err := ScanDexWithHashes(kegdir)
+	if err != nil {
+		t.Fatalf("ScanDexWithHashes (first): %v", err)
+	}
+	if len(*dex1) != 1 {
+		t.Fatalf("got %v entries, want 1", len(*dex1))
+	}
+	firstU := (*dex1)[0].U
+
+	// Bump mtime without touching content, as a git clone, an rsync
+	// without -t, or a tar extraction would.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(readme, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	dex2, err := ScanDexWithHashes(kegdir)
+	if err != nil {
+		t.Fatalf("ScanDexWithHashes (second): %v", err)
+	}
+	if gotU := (*dex2)[0].U; !gotU.Equal(firstU) {
+		t.Fatalf("update time changed on mtime-only touch: got %v, want %v", gotU, firstU)
+	}
+
+	// Now actually change the content; the update time must move.
+	if err := os.WriteFile(readme, []byte("# Node 1\n\nChanged content.\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dex3, err := ScanDexWithHashes(kegdir)
+	if err != nil {
+		t.Fatalf("ScanDexWithHashes (third): %v", err)
+	}
+	if gotU := (*dex3)[0].U; gotU.Equal(firstU) {
+		t.Fatalf("update time did not move after a real content change")
+	}
+}
+
+func TestFsck_DetectsContentDrift(t *testing.T) {
+	kegdir := t.TempDir()
+	readme := writeNode(t, kegdir, 1, "# Node 1\n\nOriginal content.\n")
+
+	if _, err := ScanDexWithHashes(kegdir); err != nil {
+		t.Fatalf("ScanDexWithHashes: %v", err)
+	}
+
+	if bad, err := Fsck(kegdir, DefaultHasher); err != nil {
+		t.Fatalf("Fsck (clean): %v", err)
+	} else if len(bad) != 0 {
+		t.Fatalf("Fsck (clean) = %+v, want no mismatches", bad)
+	}
+
+	// Modify the node's content directly, bypassing ScanDexWithHashes,
+	// so dex/hashes.tsv still records the old hash.
+	if err := os.WriteFile(readme, []byte("# Node 1\n\nTampered content.\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	bad, err := Fsck(kegdir, DefaultHasher)
+	if err != nil {
+		t.Fatalf("Fsck (tampered): %v", err)
+	}
+	if len(bad) != 1 || bad[0].Node != 1 {
+		t.Fatalf("Fsck (tampered) = %+v, want one mismatch for node 1", bad)
+	}
+	if bad[0].Recorded == bad[0].Actual {
+		t.Fatalf("Fsck reported matching hashes for a tampered node: %+v", bad[0])
+	}
+}
@@ -2,9 +2,11 @@ package keg
 
 import (
 	"bufio"
+	"context"
 	_ "embed"
 	"fmt"
 	"log"
+	"net/mail"
 	"os"
 	"path"
 	"path/filepath"
@@ -14,7 +16,12 @@ import (
 	"strings"
 	"time"
 
-	Z "github.com/rwxrob/bonzai/z"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/rwxrob/fs"
 	_fs "github.com/rwxrob/fs"
 	"github.com/rwxrob/fs/dir"
@@ -48,13 +55,15 @@ func ParseDex(in any) (*Dex, error) {
 	for line := 1; s.Scan(); line++ {
 		f := LatestDexEntryExp.FindStringSubmatch(s.Text())
 		if len(f) != 4 {
-			return nil, fmt.Errorf("bad line in latest.md: %v", line)
+			return nil, ErrLine(
+				fmt.Errorf("bad line in latest.md: %v", line), WithLine(line),
+			)
 		}
 		if t, err := time.Parse(IsoDateFmt, string(f[1])); err != nil {
-			return nil, err
+			return nil, ErrLine(err, WithLine(line))
 		} else {
 			if i, err := strconv.Atoi(f[3]); err != nil {
-				return nil, err
+				return nil, ErrLine(err, WithLine(line))
 			} else {
 				dex = append(dex, DexEntry{U: t, T: f[2], N: i})
 			}
@@ -63,8 +72,39 @@ func ParseDex(in any) (*Dex, error) {
 	return &dex, nil
 }
 
-// ReadDex reads an existing dex/latest.md dex and returns it.
+// ReadDex reads the dex for the keg at kegdir, preferring the compact
+// dex/latest.bin form and falling back to dex/latest.md when the
+// binary form is missing or stale (see ReadDexBinary), holding a
+// shared lock on the keg for the duration of the read (see
+// ReadDexContext).
 func ReadDex(kegdir string) (*Dex, error) {
+	return ReadDexContext(context.Background(), kegdir)
+}
+
+// ReadDexContext is ReadDex with a caller-supplied context used to
+// bound how long it waits to acquire the shared lock.
+func ReadDexContext(ctx context.Context, kegdir string) (*Dex, error) {
+	var dex *Dex
+	err := withSharedLock(ctx, kegdir, func() error {
+		d, err := readDexLocked(kegdir)
+		if err != nil {
+			return err
+		}
+		dex = d
+		return nil
+	})
+	return dex, err
+}
+
+// readDexLocked prefers the binary dex/latest.bin form, which is
+// faster to parse for large kegs, and falls back to dex/latest.md
+// when the binary form is missing or its version tag doesn't match
+// (see ReadDexBinary).
+func readDexLocked(kegdir string) (*Dex, error) {
+	if dex, err := ReadDexBinary(kegdir); err == nil {
+		return dex, nil
+	}
+
 	f := filepath.Join(kegdir, `dex`, `latest.md`)
 	buf, err := os.ReadFile(f)
 	if err != nil {
@@ -96,30 +136,59 @@ func ScanDex(kegdir string) (*Dex, error) {
 	return &dex, nil
 }
 
-// MakeDex calls ScanDex and writes (or overwrites) the output to the
-// reserved dex node file within the kegdir passed. File-level
-// locking is attempted using the go-internal/lockedfile (used by Go
-// itself). Both a friendly markdown file reverse sorted by time of last
-// update (latest.md) and a tab-delimited file sorted numerically by
-// node ID (nodes.tsv) are created.
+// MakeDex calls ScanDexWithHasher (using DefaultHasher) and writes (or
+// overwrites) the output to the reserved dex node file within the
+// kegdir passed, so that "updated" ordering survives a git clone,
+// rsync without -t, tar extraction, or editor save-in-place rather
+// than just reflecting raw mtimes (see ScanDexWithHasher). An
+// exclusive file-level lock on dex/.lock (see withExclusiveLock) is
+// held for the duration, and every file is written atomically via a
+// temp-file-plus-rename so a process crashing mid-write never leaves
+// a truncated dex behind. A friendly markdown file reverse sorted by
+// time of last update (latest.md), a tab-delimited file sorted
+// numerically by node ID (nodes.tsv), and a compact binary index of
+// latest.md for fast lookups on large kegs (latest.bin, see
+// WriteDexBinary) are all created.
 func MakeDex(kegdir string) error {
-	dex, err := ScanDex(kegdir)
+	return MakeDexContext(context.Background(), kegdir)
+}
+
+// MakeDexContext is MakeDex with a caller-supplied context used to
+// bound how long it waits to acquire the exclusive lock. When the
+// context expires first, the returned error wraps ctx.Err() so the
+// caller can report that another keg process holds the lock instead
+// of appearing to hang.
+func MakeDexContext(ctx context.Context, kegdir string) error {
+	return withExclusiveLock(ctx, kegdir, func() error {
+		return makeDexLocked(kegdir)
+	})
+}
+
+func makeDexLocked(kegdir string) error {
+	// Already running under withExclusiveLock (see MakeDexContext), so
+	// call the unlocked core directly rather than ScanDexWithHasher,
+	// which takes dex/.lock itself and would deadlock.
+	dex, err := scanDexWithHasherLocked(kegdir, DefaultHasher)
 	if err != nil {
-		return err
+		return ErrLine(err, WithPath(kegdir))
 	}
 
 	// markdown is first since reverse chrono of updates is default
 	mdpath := filepath.Join(kegdir, `dex`, `latest.md`)
-	if err := file.Overwrite(mdpath, dex.MD()); err != nil {
-		return err
+	if err := atomicWriteFile(mdpath, dex.MD()); err != nil {
+		return ErrLine(err, WithPath(mdpath))
 	}
 
 	tsvpath := filepath.Join(kegdir, `dex`, `nodes.tsv`)
-	if err := file.Overwrite(tsvpath, dex.ByID().TSV()); err != nil {
-		return err
+	if err := atomicWriteFile(tsvpath, dex.ByID().TSV()); err != nil {
+		return ErrLine(err, WithPath(tsvpath))
+	}
+
+	if err := WriteDexBinary(kegdir, dex, DefaultHasher.Name()); err != nil {
+		return ErrLine(err, WithPath(kegdir))
 	}
 
-	return UpdateUpdated(kegdir)
+	return updateUpdatedLocked(kegdir)
 }
 
 // ImportNode moves the nodedir into the KEG directory for the kegid giving
@@ -127,25 +196,70 @@ func MakeDex(kegdir string) error {
 // existing the the target KEG.
 func ImportNode(from, to, nodeid string) error {
 	to = path.Join(to, nodeid)
+	id, _ := strconv.Atoi(nodeid)
 	if _fs.Exists(to) {
-		return _fs.ErrorExists{to}
+		return ErrLine(_fs.ErrorExists{to}, WithPath(to), WithNodeID(id))
 	}
-	return os.Rename(from, to)
+	if err := os.Rename(from, to); err != nil {
+		return ErrLine(err, WithPath(to), WithNodeID(id))
+	}
+	return nil
 }
 
-// UpdateUpdated sets the updated YAML field in the keg info file.
+// UpdateUpdated sets the updated YAML field in the keg info file under
+// an exclusive lock (see UpdateUpdatedContext).
 func UpdateUpdated(kegpath string) error {
+	return UpdateUpdatedContext(context.Background(), kegpath)
+}
+
+// UpdateUpdatedContext is UpdateUpdated with a caller-supplied context
+// used to bound how long it waits to acquire the exclusive lock.
+func UpdateUpdatedContext(ctx context.Context, kegpath string) error {
+	return withExclusiveLock(ctx, kegpath, func() error {
+		return updateUpdatedLocked(kegpath)
+	})
+}
+
+var updatedFieldExp = regexp.MustCompile(`(?m)(^|\n)updated:.*(\n|$)`)
+
+func updateUpdatedLocked(kegpath string) error {
 	kegfile := filepath.Join(kegpath, `keg`)
-	updated := UpdatedString(kegpath)
-	return file.ReplaceAllString(
-		kegfile, `(^|\n)updated:.*(\n|$)`, `${1}updated: `+updated+`${2}`,
+	updated := updatedStringLocked(kegpath)
+	buf, err := os.ReadFile(kegfile)
+	if err != nil {
+		return err
+	}
+	out := updatedFieldExp.ReplaceAllString(
+		string(buf), `${1}updated: `+updated+`${2}`,
 	)
+	return atomicWriteFile(kegfile, out)
 }
 
 // Updated parses the most recent change time in the dex/node.md file
-// (the first line) and returns the time stamp it contains as
-// a time.Time. If a time stamp could not be determined returns time.
+// (the first line) and returns the time stamp it contains as a
+// time.Time, holding a shared lock on the keg for the duration of the
+// read (see UpdatedContext). If a time stamp could not be determined
+// returns time.
 func Updated(kegpath string) (*time.Time, error) {
+	return UpdatedContext(context.Background(), kegpath)
+}
+
+// UpdatedContext is Updated with a caller-supplied context used to
+// bound how long it waits to acquire the shared lock.
+func UpdatedContext(ctx context.Context, kegpath string) (*time.Time, error) {
+	var t *time.Time
+	err := withSharedLock(ctx, kegpath, func() error {
+		found, err := updatedLocked(kegpath)
+		if err != nil {
+			return err
+		}
+		t = found
+		return nil
+	})
+	return t, err
+}
+
+func updatedLocked(kegpath string) (*time.Time, error) {
 	kegfile := filepath.Join(kegpath, `dex`, `latest.md`)
 	str, err := file.FindString(kegfile, IsoDateExpStr)
 	if err != nil {
@@ -158,10 +272,28 @@ func Updated(kegpath string) (*time.Time, error) {
 	return &t, nil
 }
 
-// Last parses and returns a DexEntry of the most recently
-// updated node from first line of the dex/latest.md file. If cannot
+// Last parses and returns a DexEntry of the most recently updated node
+// from first line of the dex/latest.md file, holding a shared lock on
+// the keg for the duration of the read (see LastContext). If cannot
 // determine returns nil.
 func Last(kegpath string) *DexEntry {
+	return LastContext(context.Background(), kegpath)
+}
+
+// LastContext is Last with a caller-supplied context used to bound
+// how long it waits to acquire the shared lock. Like Last, it returns
+// nil rather than an error when the lock cannot be acquired or the
+// dex cannot be parsed.
+func LastContext(ctx context.Context, kegpath string) *DexEntry {
+	var entry *DexEntry
+	withSharedLock(ctx, kegpath, func() error {
+		entry = lastLocked(kegpath)
+		return nil
+	})
+	return entry
+}
+
+func lastLocked(kegpath string) *DexEntry {
 	kegfile := filepath.Join(kegpath, `dex`, `latest.md`)
 	lines, err := file.Head(kegfile, 1)
 	if err != nil || len(lines) == 0 {
@@ -185,36 +317,242 @@ func UpdatedString(kegpath string) string {
 	return (*u).Format(IsoDateFmt)
 }
 
+func updatedStringLocked(kegpath string) string {
+	u, err := updatedLocked(kegpath)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return (*u).Format(IsoDateFmt)
+}
+
 // Publish publishes the keg at kegpath location to its distribution
-// targets listed in the keg file under "publish." Currently, this only
-// involves looking for a .git directory and if found doing a git push.
-// Git commit messages are always based on the latest node title without
-// any verb.
+// targets listed in the keg file under "publish:" (one remote name per
+// "- " list item). It uses go-git directly rather than shelling out to
+// the git binary so that kegs can be published from machines without
+// git installed and without an interactive terminal. It opens the
+// repository whose .git directory is found in or above the current
+// working directory (the search does not start from kegpath),
+// stages every changed path, and commits using the author identity
+// from the keg file's "author" field (optionally signing the commit
+// with the OpenPGP key named by "sign_key"). It then pulls and pushes
+// each target in turn, using whichever credentials are configured for
+// that remote (see publishAuth); pulling per target, rather than once
+// up front, avoids assuming every keg has a remote literally named
+// "origin". Pull or push failures on one target do not prevent the
+// remaining targets from being attempted; all errors encountered are
+// returned together.
 func Publish(kegpath string) error {
+	kegfile := filepath.Join(kegpath, `keg`)
+
+	targets, err := publishTargets(kegfile)
+	if err != nil {
+		return ErrLine(err, WithPath(kegfile))
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
 	gitd, err := fs.HereOrAbove(`.git`)
 	if err != nil {
-		return err
+		return ErrLine(err, WithPath(kegpath))
 	}
-	origd, err := os.Getwd()
+
+	repo, err := git.PlainOpenWithOptions(
+		filepath.Dir(gitd), &git.PlainOpenOptions{DetectDotGit: true},
+	)
 	if err != nil {
-		return err
+		return ErrLine(err, WithPath(kegpath))
 	}
-	defer os.Chdir(origd)
-	os.Chdir(filepath.Dir(gitd))
-	if err := Z.Exec(`git`, `-C`, kegpath, `pull`); err != nil {
-		return err
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return ErrLine(err, WithPath(kegpath))
 	}
-	if err := Z.Exec(`git`, `-C`, kegpath, `add`, `-A`, `.`); err != nil {
-		return err
+
+	if err := wt.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return ErrLine(err, WithPath(kegpath))
 	}
+
 	msg := "Publish changes"
 	if n := Last(kegpath); n != nil {
 		msg = n.T
 	}
-	if err := Z.Exec(`git`, `-C`, kegpath, `commit`, `-m`, msg); err != nil {
-		return err
+
+	author, err := publishAuthor(kegfile)
+	if err != nil {
+		return ErrLine(err, WithPath(kegfile))
+	}
+
+	commitOpts := &git.CommitOptions{Author: author}
+	signer, err := publishSignKey(kegfile)
+	if err != nil {
+		return ErrLine(err, WithPath(kegfile))
+	}
+	if signer != nil {
+		commitOpts.SignKey = signer
+	}
+
+	if _, err := wt.Commit(msg, commitOpts); err != nil &&
+		err != git.ErrEmptyCommit {
+		return ErrLine(err, WithPath(kegpath))
+	}
+
+	var errstrs []string
+	for _, target := range targets {
+		auth, err := publishAuth(kegfile, target)
+		if err != nil {
+			errstrs = append(errstrs, fmt.Sprintf("%v: %v", target, err))
+			continue
+		}
+
+		// Pull per target rather than once up front with go-git's
+		// default (which always means "origin", unlike plain git
+		// pull following the branch's tracking remote): a keg whose
+		// publish list has no "origin" entry would otherwise fail
+		// before ever reaching the push loop below.
+		err = wt.Pull(&git.PullOptions{RemoteName: target, Auth: auth})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			errstrs = append(errstrs, fmt.Sprintf("%v: pull: %v", target, err))
+			continue
+		}
+
+		err = repo.Push(&git.PushOptions{RemoteName: target, Auth: auth})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			errstrs = append(errstrs, fmt.Sprintf("%v: %v", target, err))
+		}
+	}
+	if len(errstrs) > 0 {
+		return ErrLine(fmt.Errorf("publish failed for %v target(s):\n%v",
+			len(errstrs), strings.Join(errstrs, "\n")), WithPath(kegpath))
+	}
+
+	return nil
+}
+
+// publishTargets reads the list of remote names under the "publish:"
+// key of the keg file, one per "- name" item, in the order they
+// appear. An empty slice is returned (with no error) if the keg file
+// has no publish list.
+func publishTargets(kegfile string) ([]string, error) {
+	buf, err := os.ReadFile(kegfile)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	inList := false
+	for _, line := range strings.Split(string(buf), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == `publish:`:
+			inList = true
+		case inList && strings.HasPrefix(trimmed, `- `):
+			targets = append(targets, strings.TrimSpace(trimmed[2:]))
+		case inList && trimmed != "":
+			inList = false
+		}
 	}
-	return Z.Exec(`git`, `-C`, kegpath, `push`)
+
+	return targets, nil
+}
+
+// kegField returns the value of the given "field: value" line from
+// the keg file, or the empty string if the field is not set.
+func kegField(kegfile, field string) string {
+	line, err := file.FindString(kegfile, `(?m)^`+field+`:.*$`)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), field+`:`))
+}
+
+// publishAuthor builds the commit author identity from the "author"
+// field of the keg file, which must be in "Name <email>" form. If
+// unset, "keg <keg@localhost>" is used.
+func publishAuthor(kegfile string) (*object.Signature, error) {
+	raw := kegField(kegfile, `author`)
+	if raw == "" {
+		raw = `keg <keg@localhost>`
+	}
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &object.Signature{
+		Name:  addr.Name,
+		Email: addr.Address,
+		When:  time.Now(),
+	}, nil
+}
+
+// publishSignKey loads the OpenPGP private key named by the
+// "sign_key" keg file field, if any, decrypting it with the
+// passphrase from the environment variable named by
+// "sign_key_pass_env" when the key is encrypted. It returns a nil
+// entity (and no error) when "sign_key" is unset, meaning commits are
+// left unsigned.
+func publishSignKey(kegfile string) (*openpgp.Entity, error) {
+	keyfile := kegField(kegfile, `sign_key`)
+	if keyfile == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no signing key found in %v", keyfile)
+	}
+	entity := entities[0]
+
+	if passenv := kegField(kegfile, `sign_key_pass_env`); passenv != "" {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			if err := entity.PrivateKey.Decrypt([]byte(os.Getenv(passenv))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return entity, nil
+}
+
+// publishAuth selects credentials for pushing to the named publish
+// target from the keg file. Three mutually exclusive schemes are
+// supported, checked in this order:
+//
+//   - HTTP basic auth, via "http_user" (password taken from the
+//     environment variable named by "http_pass_env")
+//   - An SSH private key file, via "ssh_key" (passphrase, if any,
+//     taken from the environment variable named by "ssh_key_pass_env")
+//   - The running SSH agent, when "ssh_agent" is set to "true"
+//
+// A nil AuthMethod (with no error) is returned when none of these are
+// configured, letting go-git fall back to its own defaults (e.g. an
+// unauthenticated local or file transport).
+func publishAuth(kegfile, target string) (transport.AuthMethod, error) {
+	if user := kegField(kegfile, `http_user`); user != "" {
+		pass := os.Getenv(kegField(kegfile, `http_pass_env`))
+		return &githttp.BasicAuth{Username: user, Password: pass}, nil
+	}
+
+	if keyfile := kegField(kegfile, `ssh_key`); keyfile != "" {
+		pass := os.Getenv(kegField(kegfile, `ssh_key_pass_env`))
+		return ssh.NewPublicKeysFromFile(`git`, keyfile, pass)
+	}
+
+	if kegField(kegfile, `ssh_agent`) == `true` {
+		return ssh.NewSSHAgentAuth(`git`)
+	}
+
+	return nil, nil
 }
 
 // MakeNode examines the keg at kegpath for highest integer identifier
@@ -227,11 +565,11 @@ func MakeNode(kegpath string) (*DexEntry, error) {
 	high++
 	path := filepath.Join(kegpath, strconv.Itoa(high))
 	if err := dir.Create(path); err != nil {
-		return nil, err
+		return nil, ErrLine(err, WithPath(path), WithNodeID(high))
 	}
 	readme := filepath.Join(kegpath, `dex`, `README.md`)
 	if err := file.Touch(readme); err != nil {
-		return nil, err
+		return nil, ErrLine(err, WithPath(readme), WithNodeID(high))
 	}
 	return &DexEntry{N: high}, nil
 }
@@ -241,10 +579,15 @@ func MakeNode(kegpath string) (*DexEntry, error) {
 func Edit(kegpath string, id int) error {
 	node := strconv.Itoa(id)
 	if node == "" {
-		return fmt.Errorf(`node (%q) is not a valid node id`, id)
+		return ErrLine(
+			fmt.Errorf(`node (%q) is not a valid node id`, id), WithNodeID(id),
+		)
 	}
 	readme := filepath.Join(kegpath, node, `README.md`)
-	return file.Edit(readme)
+	if err := file.Edit(readme); err != nil {
+		return ErrLine(err, WithPath(readme), WithNodeID(id))
+	}
+	return nil
 }
 
 // DexUpdate first checks the keg at kegpath for an existing
@@ -252,26 +595,39 @@ func Edit(kegpath string, id int) error {
 // to create it. Then DexUpdate examines the Dex for the DexEntry passed
 // and if found updates it with the new information, otherwise, it will
 // add the new entry without any further validation. The updated Dex is
-// then written to the dex/latest.md file.
+// then written to the dex/latest.md file. The whole operation runs
+// under a single exclusive lock (see DexUpdateContext) so that the
+// check-then-write is atomic with respect to other keg processes.
 func DexUpdate(kegpath string, entry *DexEntry) error {
-	if !HaveDex(kegpath) {
-		if err := MakeDex(kegpath); err != nil {
-			return err
+	return DexUpdateContext(context.Background(), kegpath, entry)
+}
+
+// DexUpdateContext is DexUpdate with a caller-supplied context used
+// to bound how long it waits to acquire the exclusive lock.
+func DexUpdateContext(ctx context.Context, kegpath string, entry *DexEntry) error {
+	return withExclusiveLock(ctx, kegpath, func() error {
+		if !HaveDex(kegpath) {
+			if err := makeDexLocked(kegpath); err != nil {
+				return ErrLine(err, WithPath(kegpath), WithNodeID(entry.N))
+			}
 		}
-	}
-	entry.Update(kegpath)
-	dex, err := ReadDex(kegpath)
-	if err != nil {
-		return err
-	}
-	found := dex.Lookup(entry.N)
-	if found == nil {
-		dex.Add(entry)
-	} else {
-		found.U = entry.U
-		found.T = entry.T
-	}
-	return WriteDex(kegpath, dex)
+		entry.Update(kegpath)
+		dex, err := readDexLocked(kegpath)
+		if err != nil {
+			return ErrLine(err, WithPath(kegpath), WithNodeID(entry.N))
+		}
+		found := dex.Lookup(entry.N)
+		if found == nil {
+			dex.Add(entry)
+		} else {
+			found.U = entry.U
+			found.T = entry.T
+		}
+		if err := writeDexLocked(kegpath, dex); err != nil {
+			return ErrLine(err, WithPath(kegpath), WithNodeID(entry.N))
+		}
+		return nil
+	})
 }
 
 // Lookup does a linear search through the Dex for one with the passed
@@ -290,18 +646,39 @@ func HaveDex(kegpath string) bool {
 	return file.Exists(filepath.Join(kegpath, `dex`, `latest.md`))
 }
 
-// WriteDex writes the dex/latest.md and dex/nodes.tsv files to the keg
-// at kegpath and calls UpdateUpdated to keep keg info file in sync.
+// WriteDex writes the dex/latest.md, dex/nodes.tsv, and dex/latest.bin
+// files to the keg at kegpath and calls UpdateUpdated to keep keg info
+// file in sync, under an exclusive lock (see WriteDexContext). Every
+// file is written atomically via a temp-file-plus-rename.
 func WriteDex(kegpath string, dex *Dex) error {
+	return WriteDexContext(context.Background(), kegpath, dex)
+}
+
+// WriteDexContext is WriteDex with a caller-supplied context used to
+// bound how long it waits to acquire the exclusive lock.
+func WriteDexContext(ctx context.Context, kegpath string, dex *Dex) error {
+	return withExclusiveLock(ctx, kegpath, func() error {
+		return writeDexLocked(kegpath, dex)
+	})
+}
+
+func writeDexLocked(kegpath string, dex *Dex) error {
 	latest := filepath.Join(kegpath, `dex`, `latest.md`)
 	nodes := filepath.Join(kegpath, `dex`, `nodes.tsv`)
-	if err := file.Overwrite(latest, dex.ByLatest().MD()); err != nil {
-		return err
+	if err := atomicWriteFile(latest, dex.ByLatest().MD()); err != nil {
+		return ErrLine(err, WithPath(latest))
 	}
-	if err := file.Overwrite(nodes, dex.ByID().TSV()); err != nil {
-		return err
+	if err := atomicWriteFile(nodes, dex.ByID().TSV()); err != nil {
+		return ErrLine(err, WithPath(nodes))
+	}
+	// writeDexLocked persists whatever Dex the caller built (e.g. via
+	// DexUpdate's single-entry merge); it doesn't itself recompute
+	// node hashes, so unlike makeDexLocked it can't truthfully claim
+	// an algorithm in the latest.bin header.
+	if err := WriteDexBinary(kegpath, dex, ""); err != nil {
+		return ErrLine(err, WithPath(kegpath))
 	}
-	return UpdateUpdated(kegpath)
+	return updateUpdatedLocked(kegpath)
 }
 
 //go:embed testdata/samplekeg/1/README.md
@@ -0,0 +1,162 @@
+package keg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+// lockPath returns the path to the dex/.lock file guarding mutations
+// to the dex for the keg at kegdir.
+func lockPath(kegdir string) string {
+	return filepath.Join(kegdir, `dex`, `.lock`)
+}
+
+// withExclusiveLock runs fn while holding an exclusive lock on the
+// keg at kegdir's dex/.lock file, creating dex/ if needed. It is used
+// to guard every dex mutation (MakeDex, DexUpdate, WriteDex,
+// UpdateUpdated) so that two concurrent keg processes (an editor
+// autosave hook and a cron MakeDex, say) cannot race and corrupt
+// dex/latest.md or dex/nodes.tsv. If ctx is done before the lock is
+// acquired, an error wrapping ctx.Err() is returned so the caller can
+// report that another keg process holds the lock rather than hanging.
+func withExclusiveLock(ctx context.Context, kegdir string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Join(kegdir, `dex`), 0755); err != nil {
+		return err
+	}
+
+	path := lockPath(kegdir)
+
+	type result struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := lockedfile.Create(path)
+		done <- result{f, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		defer r.f.Close()
+		return fn()
+	case <-ctx.Done():
+		// lockedfile.Create is still blocked waiting for the OS lock
+		// above; if we just returned, its eventual result would be
+		// dropped, leaking an open fd and an indefinitely held flock
+		// once it lands. Closing it here instead of below, in its own
+		// goroutine, releases it as soon as it's acquired.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.f.Close()
+			}
+		}()
+		return fmt.Errorf(
+			"another keg process holds the lock on %v: %w", path, ctx.Err(),
+		)
+	}
+}
+
+// withSharedLock runs fn while holding a shared (read) lock on the
+// keg at kegdir's dex/.lock file, used to guard every dex read
+// (ReadDex, Last, Updated) against a concurrent writer. If ctx is done
+// before the lock is acquired, an error wrapping ctx.Err() is returned
+// so the caller can report that another keg process holds the lock
+// rather than hanging.
+func withSharedLock(ctx context.Context, kegdir string, fn func() error) error {
+	path := lockPath(kegdir)
+	if err := ensureLockFile(path); err != nil {
+		return err
+	}
+
+	type result struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := lockedfile.Open(path)
+		done <- result{f, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		defer r.f.Close()
+		return fn()
+	case <-ctx.Done():
+		// As in withExclusiveLock: lockedfile.Open is still blocked
+		// above, so close its result once it arrives instead of
+		// leaking the fd and the shared lock it holds.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.f.Close()
+			}
+		}()
+		return fmt.Errorf(
+			"another keg process holds the lock on %v: %w", path, ctx.Err(),
+		)
+	}
+}
+
+// ensureLockFile makes sure the dex/.lock file exists so that
+// lockedfile.Open (which requires the file to already exist) can take
+// a shared lock on it.
+func ensureLockFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// atomicWriteFile writes content to path by writing it to a temp file
+// in the same directory and renaming it into place, which is atomic
+// on POSIX filesystems, so a process that crashes mid-write never
+// leaves a truncated file behind.
+func atomicWriteFile(path, content string) error {
+	return atomicWriteBytes(path, []byte(content))
+}
+
+// atomicWriteBytes is atomicWriteFile for raw (e.g. binary) content.
+func atomicWriteBytes(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, `.`+filepath.Base(path)+`.tmp-*`)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
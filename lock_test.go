@@ -0,0 +1,38 @@
+package keg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+func TestMakeDexContext_TimesOutPromptlyWhenLockHeld(t *testing.T) {
+	kegdir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(kegdir, `dex`), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	held, err := lockedfile.Create(lockPath(kegdir))
+	if err != nil {
+		t.Fatalf("pre-acquiring dex/.lock: %v", err)
+	}
+	defer held.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = MakeDexContext(ctx, kegdir)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("MakeDexContext succeeded while dex/.lock was already held")
+	}
+	if elapsed > time.Second {
+		t.Fatalf("MakeDexContext took %v to return after the lock timeout, want well under 1s", elapsed)
+	}
+}
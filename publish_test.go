@@ -0,0 +1,75 @@
+package keg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+func writeKegFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), `keg`)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestPublishTargets_ReadsListInOrder(t *testing.T) {
+	kegfile := writeKegFile(t, "title: Test\npublish:\n  - origin\n  - mirror\nauthor: x\n")
+
+	targets, err := publishTargets(kegfile)
+	if err != nil {
+		t.Fatalf("publishTargets: %v", err)
+	}
+	want := []string{`origin`, `mirror`}
+	if len(targets) != len(want) || targets[0] != want[0] || targets[1] != want[1] {
+		t.Fatalf("publishTargets = %v, want %v", targets, want)
+	}
+}
+
+func TestPublishAuth_SelectsBySchemeInOrder(t *testing.T) {
+	t.Run(`http basic auth`, func(t *testing.T) {
+		t.Setenv(`KEG_TEST_HTTP_PASS`, `secret`)
+		kegfile := writeKegFile(t, "http_user: alice\nhttp_pass_env: KEG_TEST_HTTP_PASS\n")
+
+		auth, err := publishAuth(kegfile, `origin`)
+		if err != nil {
+			t.Fatalf("publishAuth: %v", err)
+		}
+		basic, ok := auth.(*githttp.BasicAuth)
+		if !ok {
+			t.Fatalf("publishAuth = %T, want *githttp.BasicAuth", auth)
+		}
+		if basic.Username != `alice` || basic.Password != `secret` {
+			t.Fatalf("publishAuth = %+v, want Username alice, Password secret", basic)
+		}
+	})
+
+	t.Run(`ssh agent`, func(t *testing.T) {
+		kegfile := writeKegFile(t, "ssh_agent: true\n")
+
+		auth, err := publishAuth(kegfile, `origin`)
+		if err != nil {
+			t.Fatalf("publishAuth: %v", err)
+		}
+		if _, ok := auth.(*ssh.PublicKeysCallback); !ok {
+			t.Fatalf("publishAuth = %T, want *ssh.PublicKeysCallback", auth)
+		}
+	})
+
+	t.Run(`no scheme configured`, func(t *testing.T) {
+		kegfile := writeKegFile(t, "title: Test\n")
+
+		auth, err := publishAuth(kegfile, `origin`)
+		if err != nil {
+			t.Fatalf("publishAuth: %v", err)
+		}
+		if auth != nil {
+			t.Fatalf("publishAuth = %v, want nil (let go-git use its own default)", auth)
+		}
+	})
+}